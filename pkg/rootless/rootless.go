@@ -1,8 +1,17 @@
 package rootless
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"os"
+	"os/exec"
+	"os/signal"
+	osuser "os/user"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/containers/storage"
 	"github.com/opencontainers/runc/libcontainer/user"
@@ -49,42 +58,268 @@ func TryJoinPauseProcess(pausePidPath string) (bool, int, error) {
 	return became, ret, err
 }
 
-var (
-	uidMap      []user.IDMap
-	uidMapError error
-	uidMapOnce  sync.Once
+// TryJoinPauseProcesses attempts to join the namespaces of one of the given
+// candidate pause PID files, in order, via TryJoinPauseProcess.  It is used
+// when a rootless session keeps more than one pause process alive -- one per
+// distinct uid/gid mapping -- so that it can find the pause process that
+// matches the mapping the caller is about to use instead of always joining
+// the first one that was ever created.  The first candidate that can be
+// joined wins; candidates whose PID file is missing, or whose pause process
+// cannot be joined (TryJoinPauseProcess then removes the PID file), are
+// skipped, and (false, -1, nil) is returned when none is joined so the
+// caller can fall back to starting a new pause process.
+func TryJoinPauseProcesses(pausePidPaths []string) (bool, int, error) {
+	for _, pausePidPath := range pausePidPaths {
+		became, ret, err := TryJoinPauseProcess(pausePidPath)
+		if err != nil {
+			return false, -1, err
+		}
+		// ret == -1 means the candidate's PID file was missing or stale;
+		// move on to the next candidate instead of giving up entirely.
+		if ret != -1 {
+			return became, ret, nil
+		}
+	}
+	return false, -1, nil
+}
 
-	gidMap      []user.IDMap
-	gidMapError error
-	gidMapOnce  sync.Once
+// pausePIDForMapping keys the pool of known pause processes by the
+// uid/gid mapping they were created with, so containers that request
+// distinct --uidmap/--gidmap values spawn their own pause process
+// instead of clashing over a single shared one.
+var (
+	pausePIDForMappingMutex sync.Mutex
+	pausePIDForMapping      = map[string]string{}
 )
 
-// GetAvailableUidMap returns the UID mappings in the
-// current user namespace.
-func GetAvailableUidMap() ([]user.IDMap, error) {
-	uidMapOnce.Do(func() {
-		var err error
-		uidMap, err = user.ParseIDMapFile("/proc/self/uid_map")
+// idMappingKey returns a stable key identifying the given uid/gid
+// mappings, suitable for indexing the pause-process pool.
+func idMappingKey(uidMappings, gidMappings []user.IDMap) string {
+	var sb strings.Builder
+	for _, m := range uidMappings {
+		fmt.Fprintf(&sb, "u%d:%d:%d;", m.ID, m.ParentID, m.Count)
+	}
+	for _, m := range gidMappings {
+		fmt.Fprintf(&sb, "g%d:%d:%d;", m.ID, m.ParentID, m.Count)
+	}
+	return sb.String()
+}
+
+// RegisterPausePIDPath records pausePidPath as the pause PID file to use
+// for the given uid/gid mappings, so that a later PausePIDPathForMapping
+// call with the same mappings returns it while the file still exists.
+func RegisterPausePIDPath(pausePidPath string, uidMappings, gidMappings []user.IDMap) {
+	key := idMappingKey(uidMappings, gidMappings)
+
+	pausePIDForMappingMutex.Lock()
+	defer pausePIDForMappingMutex.Unlock()
+	pausePIDForMapping[key] = pausePidPath
+}
+
+// PausePIDPathForMapping returns the pause PID file path previously
+// registered for the given uid/gid mappings, and whether one was found.
+// An entry whose PID file no longer exists -- e.g. because
+// TryJoinPauseProcess removed it after failing to join a dead pause
+// process -- is evicted instead of being handed back, so a long-running
+// process such as "podman system service" does not accumulate stale
+// paths for mappings it saw once and will never reuse.
+func PausePIDPathForMapping(uidMappings, gidMappings []user.IDMap) (string, bool) {
+	key := idMappingKey(uidMappings, gidMappings)
+
+	pausePIDForMappingMutex.Lock()
+	defer pausePIDForMappingMutex.Unlock()
+	pausePidPath, ok := pausePIDForMapping[key]
+	if !ok {
+		return "", false
+	}
+	if _, err := os.Stat(pausePidPath); err != nil {
+		delete(pausePIDForMapping, key)
+		return "", false
+	}
+	return pausePidPath, true
+}
+
+// TryJoinPauseProcessForMapping is the pool-aware counterpart of
+// TryJoinPauseProcesses: it first tries the pause PID path already
+// registered (via RegisterPausePIDPath) for this exact uid/gid mapping,
+// then falls through to pausePidPaths, and finally registers whichever
+// candidate it joined so that later calls for the same
+// mapping find the right pause process straight away instead of
+// racing other mappings for the first candidate in the list.
+//
+// Nothing in this package calls this yet: selecting or generating the
+// per-mapping pausePidPaths candidates for a given --uidmap/--gidmap is
+// the job of whatever constructs a container's pause process (in
+// libpod, outside this chunk), and that caller is not part of this
+// chunk's tree. This function is the primitive that caller is expected
+// to use; wiring it in is tracked separately, not claimed as done here.
+func TryJoinPauseProcessForMapping(uidMappings, gidMappings []user.IDMap, pausePidPaths []string) (bool, int, error) {
+	candidates := pausePidPaths
+	if known, ok := PausePIDPathForMapping(uidMappings, gidMappings); ok {
+		candidates = append([]string{known}, candidates...)
+	}
+
+	for _, pausePidPath := range candidates {
+		became, ret, err := TryJoinPauseProcess(pausePidPath)
 		if err != nil {
-			uidMapError = err
-			return
+			return false, -1, err
 		}
-	})
+		if ret != -1 {
+			RegisterPausePIDPath(pausePidPath, uidMappings, gidMappings)
+			return became, ret, nil
+		}
+	}
+	return false, -1, nil
+}
+
+var (
+	uidMapMutex  sync.Mutex
+	uidMap       []user.IDMap
+	uidMapError  error
+	uidMapLoaded bool
+
+	gidMapMutex  sync.Mutex
+	gidMap       []user.IDMap
+	gidMapError  error
+	gidMapLoaded bool
+)
+
+// GetAvailableUidMap returns the UID mappings already applied to the
+// current user namespace.  Once Podman has re-exec'd into a user
+// namespace, this only reflects the (usually tiny) range that was
+// actually mapped, not the full range the user is entitled to -- use
+// GetConfiguredUidMap for that.
+//
+// The result is cached until the cache is invalidated; a SIGHUP handler
+// is started (once, the first time any of the GetAvailable*/GetConfigured*
+// functions in this package is called) to call InvalidateIDMapCache, so
+// that sending SIGHUP to e.g. a long-running "podman system service" makes
+// its next call re-read /proc/self/uid_map. GetConfiguredUidMap keeps no
+// cache and reads /etc/subuid on every call. Call InvalidateUidMapCache
+// directly to force a re-read on demand instead.
+func GetAvailableUidMap() ([]user.IDMap, error) {
+	ensureSIGHUPWatch()
+
+	uidMapMutex.Lock()
+	defer uidMapMutex.Unlock()
+	if !uidMapLoaded {
+		uidMap, uidMapError = user.ParseIDMapFile("/proc/self/uid_map")
+		uidMapLoaded = true
+	}
 	return uidMap, uidMapError
 }
 
-// GetAvailableGidMap returns the GID mappings in the
-// current user namespace.
+// GetAvailableGidMap returns the GID mappings already applied to the
+// current user namespace.  See GetAvailableUidMap for the same caveat
+// about GetConfiguredGidMap, and for the cache invalidation rules.
 func GetAvailableGidMap() ([]user.IDMap, error) {
-	gidMapOnce.Do(func() {
-		var err error
-		gidMap, err = user.ParseIDMapFile("/proc/self/gid_map")
-		if err != nil {
-			gidMapError = err
+	ensureSIGHUPWatch()
+
+	gidMapMutex.Lock()
+	defer gidMapMutex.Unlock()
+	if !gidMapLoaded {
+		gidMap, gidMapError = user.ParseIDMapFile("/proc/self/gid_map")
+		gidMapLoaded = true
+	}
+	return gidMap, gidMapError
+}
+
+// InvalidateUidMapCache drops the cached result of GetAvailableUidMap,
+// so the next call re-reads /proc/self/uid_map.
+func InvalidateUidMapCache() {
+	uidMapMutex.Lock()
+	defer uidMapMutex.Unlock()
+	uidMap, uidMapError = nil, nil
+	uidMapLoaded = false
+}
+
+// InvalidateGidMapCache drops the cached result of GetAvailableGidMap,
+// so the next call re-reads /proc/self/gid_map.
+func InvalidateGidMapCache() {
+	gidMapMutex.Lock()
+	defer gidMapMutex.Unlock()
+	gidMap, gidMapError = nil, nil
+	gidMapLoaded = false
+}
+
+// InvalidateIDMapCache drops the cached results of GetAvailableUidMap
+// and GetAvailableGidMap.  Long-running processes such as "podman
+// system service" should call this (see WatchSIGHUP) whenever the
+// mapping they started with may no longer be accurate -- for example
+// after the process re-execs into a different user namespace.
+// GetConfiguredUidMap and GetConfiguredGidMap keep no cache, so edits
+// to /etc/subuid or /etc/subgid reach them without this call.
+func InvalidateIDMapCache() {
+	InvalidateUidMapCache()
+	InvalidateGidMapCache()
+}
+
+// WatchSIGHUP starts a goroutine that calls InvalidateIDMapCache
+// whenever the process receives SIGHUP, and returns a function that
+// stops it. It is started automatically (see ensureSIGHUPWatch) the
+// first time this package's id-map getters are used, so that a
+// long-running process such as "podman system service" re-reads its
+// cached uid/gid maps on SIGHUP without needing an explicit call
+// from its own startup path; call WatchSIGHUP directly only if you need
+// to stop the automatic watch (via the returned func) or restart it.
+//
+// Calling WatchSIGHUP again before stopping a previous watch is safe:
+// the previous watch is stopped first, so there is never more than one
+// goroutine handling SIGHUP for this package at a time.
+func WatchSIGHUP() (stop func()) {
+	watchSIGHUPMutex.Lock()
+	defer watchSIGHUPMutex.Unlock()
+
+	if watchSIGHUPStop != nil {
+		watchSIGHUPStop()
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sighup:
+				InvalidateIDMapCache()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stopped := false
+	watchSIGHUPStop = func() {
+		if stopped {
 			return
 		}
+		stopped = true
+		signal.Stop(sighup)
+		close(done)
+	}
+	return watchSIGHUPStop
+}
+
+var (
+	watchSIGHUPMutex sync.Mutex
+	watchSIGHUPStop  func()
+
+	watchSIGHUPOnce sync.Once
+)
+
+// ensureSIGHUPWatch makes sure WatchSIGHUP has run at least once. It is
+// called from this package's exported id-map getters so that, as soon
+// as anything in a process actually uses this package's uid/gid mapping
+// data, SIGHUP refreshes that process's cached uid/gid maps without a
+// restart -- without requiring a separate service entry point to
+// remember to call WatchSIGHUP itself. A caller that wants explicit
+// control (e.g. to stop watching) can still call WatchSIGHUP directly;
+// doing so replaces this automatically-started watch.
+func ensureSIGHUPWatch() {
+	watchSIGHUPOnce.Do(func() {
+		WatchSIGHUP()
 	})
-	return gidMap, gidMapError
 }
 
 func countAvailableIDs(mappings []user.IDMap) int64 {
@@ -95,8 +330,9 @@ func countAvailableIDs(mappings []user.IDMap) int64 {
 	return availableUids
 }
 
-// GetAvailableUids returns how many UIDs are available in the
-// current user namespace.
+// GetAvailableUids returns how many UIDs are mapped into the
+// current user namespace.  See GetConfiguredUids for how many the
+// user is actually entitled to.
 func GetAvailableUids() (int64, error) {
 	uids, err := GetAvailableUidMap()
 	if err != nil {
@@ -106,8 +342,9 @@ func GetAvailableUids() (int64, error) {
 	return countAvailableIDs(uids), nil
 }
 
-// GetAvailableGids returns how many GIDs are available in the
-// current user namespace.
+// GetAvailableGids returns how many GIDs are mapped into the
+// current user namespace.  See GetConfiguredGids for how many the
+// user is actually entitled to.
 func GetAvailableGids() (int64, error) {
 	gids, err := GetAvailableGidMap()
 	if err != nil {
@@ -116,3 +353,177 @@ func GetAvailableGids() (int64, error) {
 
 	return countAvailableIDs(gids), nil
 }
+
+// GetConfiguredUidMap returns the UID mappings the current user is
+// configured to be allowed to use: the user's own UID, plus whatever
+// /etc/subuid (or getsubids(1), for users whose subordinate IDs come
+// from a remote source) grants it.  Unlike GetAvailableUidMap, this
+// does not depend on whether Podman has already re-exec'd into a user
+// namespace.
+func GetConfiguredUidMap() ([]user.IDMap, error) {
+	return getConfiguredIDMap(false)
+}
+
+// GetConfiguredGidMap is the GID equivalent of GetConfiguredUidMap,
+// reading /etc/subgid (or getsubids(1) -g).
+func GetConfiguredGidMap() ([]user.IDMap, error) {
+	return getConfiguredIDMap(true)
+}
+
+// GetConfiguredUids returns how many UIDs the current user is
+// configured to be allowed to use, per GetConfiguredUidMap.
+func GetConfiguredUids() (int64, error) {
+	uids, err := GetConfiguredUidMap()
+	if err != nil {
+		return -1, err
+	}
+
+	return countAvailableIDs(uids), nil
+}
+
+// GetConfiguredGids returns how many GIDs the current user is
+// configured to be allowed to use, per GetConfiguredGidMap.
+func GetConfiguredGids() (int64, error) {
+	gids, err := GetConfiguredGidMap()
+	if err != nil {
+		return -1, err
+	}
+
+	return countAvailableIDs(gids), nil
+}
+
+func getConfiguredIDMap(isGID bool) ([]user.IDMap, error) {
+	ensureSIGHUPWatch()
+
+	username, err := rootlessUsername()
+	if err != nil {
+		return nil, err
+	}
+
+	hostID := int64(rootlessUID())
+	if isGID {
+		hostID = int64(rootlessGID())
+	}
+
+	subIDs, err := readSubIDRanges(username, isGID)
+	if err != nil {
+		return nil, err
+	}
+
+	idMap := []user.IDMap{{ID: 0, ParentID: hostID, Count: 1}}
+	nextID := int64(1)
+	for _, r := range subIDs {
+		idMap = append(idMap, user.IDMap{ID: nextID, ParentID: r.SubID, Count: r.Count})
+		nextID += r.Count
+	}
+	return idMap, nil
+}
+
+// rootlessUID returns the original (pre-re-exec) UID of the user that
+// started Podman.  Podman re-execs itself into a user namespace before
+// most of its code runs, at which point os.Getuid() would only report
+// the (usually 0) in-namespace id, so the real uid is propagated across
+// the re-exec via _CONTAINERS_ROOTLESS_UID; fall back to os.Getuid()
+// when that is unset or not a number, as before the re-exec or when not
+// running rootless.
+func rootlessUID() int {
+	if uidEnv := os.Getenv("_CONTAINERS_ROOTLESS_UID"); uidEnv != "" {
+		if uid, err := strconv.Atoi(uidEnv); err == nil {
+			return uid
+		}
+	}
+	return os.Getuid()
+}
+
+// rootlessGID is the GID equivalent of rootlessUID, reading
+// _CONTAINERS_ROOTLESS_GID.
+func rootlessGID() int {
+	if gidEnv := os.Getenv("_CONTAINERS_ROOTLESS_GID"); gidEnv != "" {
+		if gid, err := strconv.Atoi(gidEnv); err == nil {
+			return gid
+		}
+	}
+	return os.Getgid()
+}
+
+// rootlessUsername resolves the username of the original (pre-re-exec)
+// user via rootlessUID, rather than osuser.Current(), which would
+// resolve the in-namespace uid to the wrong account once Podman has
+// re-exec'd.
+func rootlessUsername() (string, error) {
+	uid := rootlessUID()
+	u, err := osuser.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return "", errors.Wrapf(err, "error looking up user with uid %d", uid)
+	}
+	return u.Username, nil
+}
+
+// readSubIDRanges returns the subordinate ID ranges assigned to
+// username, reading them from /etc/subuid or /etc/subgid first and
+// falling back to getsubids(1) -- which shadow-utils ships as the
+// supported way to resolve subordinate IDs that come from a remote
+// source such as LDAP or SSSD -- if the local files don't have an
+// entry for the user.
+func readSubIDRanges(username string, isGID bool) ([]user.SubID, error) {
+	path := "/etc/subuid"
+	if isGID {
+		path = "/etc/subgid"
+	}
+
+	subIDs, err := user.ParseSubIDFileFilter(path, func(s user.SubID) bool { return s.Name == username })
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "error parsing %s", path)
+	}
+	if len(subIDs) > 0 {
+		return subIDs, nil
+	}
+
+	return getSubIDsViaCommand(username, isGID)
+}
+
+// getSubIDsViaCommand shells out to getsubids(1), if it is installed,
+// and parses its output via parseGetSubIDsOutput.
+func getSubIDsViaCommand(username string, isGID bool) ([]user.SubID, error) {
+	args := []string{username}
+	if isGID {
+		args = append([]string{"-g"}, args...)
+	}
+
+	out, err := exec.Command("getsubids", args...).Output()
+	if err != nil {
+		var execErr *exec.Error
+		if errors.As(err, &execErr) && errors.Is(execErr.Err, exec.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error running getsubids for %s", username)
+	}
+
+	return parseGetSubIDsOutput(out, username)
+}
+
+// parseGetSubIDsOutput parses getsubids(1) output lines of the form
+// "<n>: <name> <start> <count>" into SubID ranges for username. Lines
+// that don't parse as expected are skipped rather than treated as a
+// fatal error, since getsubids is not guaranteed to be the only thing
+// writing to its own stdout (e.g. a wrapper script emitting a banner).
+func parseGetSubIDsOutput(out []byte, username string) ([]user.SubID, error) {
+	var subIDs []user.SubID
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		start, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		subIDs = append(subIDs, user.SubID{Name: username, SubID: start, Count: count})
+	}
+	return subIDs, scanner.Err()
+}
@@ -0,0 +1,135 @@
+package rootless
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+func TestIDMappingKey(t *testing.T) {
+	a := []user.IDMap{{ID: 0, ParentID: 1000, Count: 1}}
+	b := []user.IDMap{{ID: 0, ParentID: 2000, Count: 1}}
+
+	if idMappingKey(a, nil) != idMappingKey(a, nil) {
+		t.Error("the same mapping should produce a stable key")
+	}
+	if idMappingKey(a, nil) == idMappingKey(b, nil) {
+		t.Error("different uid mappings should produce different keys")
+	}
+	if idMappingKey(nil, a) == idMappingKey(a, nil) {
+		t.Error("the same ranges used as uid vs gid mappings should produce different keys")
+	}
+}
+
+func TestPausePIDPathForMappingEvictsStaleEntry(t *testing.T) {
+	uidMappings := []user.IDMap{{ID: 0, ParentID: 424242, Count: 1}}
+	gidMappings := []user.IDMap{{ID: 0, ParentID: 424242, Count: 1}}
+
+	pausePidPath := filepath.Join(t.TempDir(), "pause.pid")
+	if err := os.WriteFile(pausePidPath, []byte("1"), 0o644); err != nil {
+		t.Fatalf("writing fake pause pid file: %v", err)
+	}
+
+	RegisterPausePIDPath(pausePidPath, uidMappings, gidMappings)
+	if got, ok := PausePIDPathForMapping(uidMappings, gidMappings); !ok || got != pausePidPath {
+		t.Fatalf("PausePIDPathForMapping = %q, %v; want %q, true", got, ok, pausePidPath)
+	}
+
+	// Simulate the pause process dying and TryJoinPauseProcess removing
+	// its now-stale PID file.
+	if err := os.Remove(pausePidPath); err != nil {
+		t.Fatalf("removing fake pause pid file: %v", err)
+	}
+
+	if got, ok := PausePIDPathForMapping(uidMappings, gidMappings); ok {
+		t.Fatalf("PausePIDPathForMapping = %q, true; want entry to be evicted once its PID file is gone", got)
+	}
+
+	// The pool entry should really be gone, not just skipped: the pool
+	// map itself must no longer hold the evicted key.
+	key := idMappingKey(uidMappings, gidMappings)
+	pausePIDForMappingMutex.Lock()
+	_, stillPresent := pausePIDForMapping[key]
+	pausePIDForMappingMutex.Unlock()
+	if stillPresent {
+		t.Fatal("evicted mapping is still present in the pool map")
+	}
+}
+
+func TestParseGetSubIDsOutput(t *testing.T) {
+	out := "0: someuser 100000 65536\n1: someuser 165536 65536\n"
+
+	subIDs, err := parseGetSubIDsOutput([]byte(out), "someuser")
+	if err != nil {
+		t.Fatalf("parseGetSubIDsOutput: %v", err)
+	}
+
+	want := []user.SubID{
+		{Name: "someuser", SubID: 100000, Count: 65536},
+		{Name: "someuser", SubID: 165536, Count: 65536},
+	}
+	if len(subIDs) != len(want) {
+		t.Fatalf("parseGetSubIDsOutput returned %d ranges, want %d: %+v", len(subIDs), len(want), subIDs)
+	}
+	for i, got := range subIDs {
+		if got != want[i] {
+			t.Errorf("range %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestInvalidateUidMapCache(t *testing.T) {
+	if _, err := GetAvailableUidMap(); err != nil {
+		t.Skipf("cannot read /proc/self/uid_map in this environment: %v", err)
+	}
+	if !uidMapLoaded {
+		t.Fatal("expected uidMapLoaded to be true after GetAvailableUidMap")
+	}
+
+	InvalidateUidMapCache()
+	if uidMapLoaded {
+		t.Fatal("expected uidMapLoaded to be false right after InvalidateUidMapCache")
+	}
+
+	if _, err := GetAvailableUidMap(); err != nil {
+		t.Fatalf("GetAvailableUidMap after invalidate: %v", err)
+	}
+	if !uidMapLoaded {
+		t.Fatal("expected uidMapLoaded to be true again after re-reading")
+	}
+}
+
+func TestInvalidateGidMapCache(t *testing.T) {
+	if _, err := GetAvailableGidMap(); err != nil {
+		t.Skipf("cannot read /proc/self/gid_map in this environment: %v", err)
+	}
+	if !gidMapLoaded {
+		t.Fatal("expected gidMapLoaded to be true after GetAvailableGidMap")
+	}
+
+	InvalidateGidMapCache()
+	if gidMapLoaded {
+		t.Fatal("expected gidMapLoaded to be false right after InvalidateGidMapCache")
+	}
+
+	if _, err := GetAvailableGidMap(); err != nil {
+		t.Fatalf("GetAvailableGidMap after invalidate: %v", err)
+	}
+	if !gidMapLoaded {
+		t.Fatal("expected gidMapLoaded to be true again after re-reading")
+	}
+}
+
+func TestParseGetSubIDsOutputSkipsMalformedLines(t *testing.T) {
+	out := "garbage line\n0: someuser notanumber 65536\n1: someuser 165536 65536\n"
+
+	subIDs, err := parseGetSubIDsOutput([]byte(out), "someuser")
+	if err != nil {
+		t.Fatalf("parseGetSubIDsOutput: %v", err)
+	}
+	if len(subIDs) != 1 || subIDs[0].SubID != 165536 {
+		t.Fatalf("parseGetSubIDsOutput = %+v; want only the one well-formed range", subIDs)
+	}
+}